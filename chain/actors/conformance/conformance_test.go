@@ -0,0 +1,65 @@
+package conformance
+
+import (
+	"context"
+	"flag"
+	"testing"
+)
+
+var (
+	corpusDir = flag.String("conformance.corpus", "testdata", "directory of conformance test vectors")
+	generate  = flag.String("conformance.generate", "", "re-run the vector file at this path and overwrite its expected results with the harness output instead of checking it")
+)
+
+// TestConformance runs every vector in -conformance.corpus as a subtest. Run
+// with -conformance.generate=<path> instead to execute the single existing
+// vector file at <path> (-conformance.corpus is not used then) and
+// overwrite it with the ApplyRet/state root the current tree actually
+// produces.
+func TestConformance(t *testing.T) {
+	if *generate != "" {
+		v, err := loadVector(*generate)
+		if err != nil {
+			t.Fatalf("loading vector to regenerate: %+v", err)
+		}
+
+		results, _, vmi, err := Run(context.Background(), v)
+		if err != nil {
+			t.Fatalf("running vector: %+v", err)
+		}
+		for i, r := range results {
+			if r.Err != nil {
+				t.Fatalf("message %d: applying: %+v", i, r.Err)
+			}
+			v.Messages[i].ExitCode = uint8(r.ApplyRet.ExitCode)
+			v.Messages[i].Return = r.ApplyRet.Return
+			v.Messages[i].GasUsed = r.ApplyRet.GasUsed
+		}
+
+		stateroot, err := vmi.Flush(context.Background())
+		if err != nil {
+			t.Fatalf("flushing vm: %+v", err)
+		}
+		v.PostStateRoot = stateroot
+
+		if err := WriteVector(*generate, v); err != nil {
+			t.Fatalf("writing vector: %+v", err)
+		}
+		return
+	}
+
+	vectors, err := LoadCorpus(*corpusDir)
+	if err != nil {
+		t.Fatalf("loading corpus: %+v", err)
+	}
+	if len(vectors) == 0 {
+		t.Skipf("no vectors found in %s", *corpusDir)
+	}
+
+	for _, nv := range vectors {
+		nv := nv
+		t.Run(nv.Name, func(t *testing.T) {
+			RunVector(t, nv.Vector)
+		})
+	}
+}
@@ -0,0 +1,126 @@
+package conformance
+
+import (
+	"context"
+	"testing"
+
+	dstore "github.com/ipfs/go-datastore"
+	hamt "github.com/ipfs/go-hamt-ipld"
+	blockstore "github.com/ipfs/go-ipfs-blockstore"
+	bstore "github.com/ipfs/go-ipfs-blockstore"
+	"golang.org/x/xerrors"
+
+	"github.com/filecoin-project/go-lotus/chain/address"
+	"github.com/filecoin-project/go-lotus/chain/gen"
+	"github.com/filecoin-project/go-lotus/chain/state"
+	"github.com/filecoin-project/go-lotus/chain/store"
+	"github.com/filecoin-project/go-lotus/chain/types"
+	"github.com/filecoin-project/go-lotus/chain/vm"
+)
+
+// Result is the outcome of running a single message from a Vector.
+type Result struct {
+	ApplyRet *vm.ApplyRet
+	Err      error
+}
+
+// Run applies the messages in v against a freshly built pre-state, in
+// order, and returns the per-message results along with the blockstore and
+// VM they ran against. It stops after the first message whose application
+// returns an error, so the results then end with that message's entry. It
+// doesn't assert anything itself.
+func Run(ctx context.Context, v *Vector) ([]Result, blockstore.Blockstore, *vm.VM, error) {
+	bs := bstore.NewBlockstore(dstore.NewMapDatastore())
+
+	accounts := make(map[address.Address]types.BigInt, len(v.PreState.Accounts))
+	for _, a := range v.PreState.Accounts {
+		accounts[a.Addr] = a.Balance
+	}
+
+	st, err := gen.MakeInitialStateTree(bs, accounts)
+	if err != nil {
+		return nil, nil, nil, xerrors.Errorf("building pre-state tree: %w", err)
+	}
+
+	for _, a := range v.PreState.Actors {
+		err := st.SetActor(a.Addr, &types.Actor{
+			Code:    a.Code,
+			Head:    a.Head,
+			Balance: a.Balance,
+			Nonce:   a.Nonce,
+		})
+		if err != nil {
+			return nil, nil, nil, xerrors.Errorf("installing actor %s: %w", a.Addr, err)
+		}
+	}
+
+	stateroot, err := st.Flush()
+	if err != nil {
+		return nil, nil, nil, xerrors.Errorf("flushing pre-state: %w", err)
+	}
+
+	cs := store.NewChainStore(bs, nil)
+	vmi, err := vm.NewVM(stateroot, v.PreState.Epoch, v.PreState.Miner, cs)
+	if err != nil {
+		return nil, nil, nil, xerrors.Errorf("creating vm: %w", err)
+	}
+
+	results := make([]Result, 0, len(v.Messages))
+	for _, mv := range v.Messages {
+		msg := mv.Msg
+		ret, err := vmi.ApplyMessage(ctx, &msg)
+		results = append(results, Result{ApplyRet: ret, Err: err})
+		if err != nil {
+			return results, bs, vmi, nil
+		}
+	}
+
+	return results, bs, vmi, nil
+}
+
+// RunVector runs v through the VM and fails t if any ApplyRet diverges from
+// the expected exit code, return value, or gas used, or if the resulting
+// state root doesn't match v.PostStateRoot. GasUsed and PostStateRoot are
+// only checked when set, so a vector can pin just the fields it cares about.
+func RunVector(t testing.TB, v *Vector) {
+	t.Helper()
+
+	results, bs, vmi, err := Run(context.Background(), v)
+	if err != nil {
+		t.Fatalf("running vector: %+v", err)
+	}
+
+	if len(results) != len(v.Messages) {
+		t.Fatalf("expected %d results, got %d", len(v.Messages), len(results))
+	}
+
+	for i, r := range results {
+		mv := v.Messages[i]
+		if r.Err != nil {
+			t.Fatalf("message %d: applying: %+v", i, r.Err)
+		}
+		if uint8(r.ApplyRet.ExitCode) != mv.ExitCode {
+			t.Errorf("message %d: expected exit code %d, got %d", i, mv.ExitCode, r.ApplyRet.ExitCode)
+		}
+		if string(r.ApplyRet.Return) != string(mv.Return) {
+			t.Errorf("message %d: return value mismatch", i)
+		}
+		if mv.GasUsed != 0 && r.ApplyRet.GasUsed != mv.GasUsed {
+			t.Errorf("message %d: expected gas used %d, got %d", i, mv.GasUsed, r.ApplyRet.GasUsed)
+		}
+	}
+
+	stateroot, err := vmi.Flush(context.Background())
+	if err != nil {
+		t.Fatalf("flushing vm: %+v", err)
+	}
+	if v.PostStateRoot.Defined() && !stateroot.Equals(v.PostStateRoot) {
+		t.Errorf("post-state root mismatch: expected %s, got %s", v.PostStateRoot, stateroot)
+	}
+
+	// Sanity check that the resulting root actually loads as a state tree.
+	cst := hamt.CSTFromBstore(bs)
+	if _, err := state.LoadStateTree(cst, stateroot); err != nil {
+		t.Fatalf("loading resulting state tree: %+v", err)
+	}
+}
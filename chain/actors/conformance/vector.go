@@ -0,0 +1,112 @@
+package conformance
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+
+	"github.com/ipfs/go-cid"
+	"golang.org/x/xerrors"
+
+	"github.com/filecoin-project/go-lotus/chain/address"
+	"github.com/filecoin-project/go-lotus/chain/types"
+)
+
+// AccountVector is a funded account to install in the pre-state of a
+// Vector. A slice rather than a map keyed by address.Address, since
+// address.Address isn't a string-kind or TextMarshaler type and can't be
+// used as an encoding/json map key.
+type AccountVector struct {
+	Addr    address.Address
+	Balance types.BigInt
+}
+
+// ActorVector describes an actor that must exist in the pre-state of a
+// Vector, independent of the ones implied by PreState.Accounts.
+type ActorVector struct {
+	Addr    address.Address
+	Code    cid.Cid
+	Head    cid.Cid
+	Balance types.BigInt
+	Nonce   uint64
+}
+
+// PreState captures everything needed to build the state tree a Vector's
+// messages are applied against.
+type PreState struct {
+	Epoch    types.ChainEpoch
+	Miner    address.Address
+	Accounts []AccountVector
+	Actors   []ActorVector
+}
+
+// MessageVector is a single message paired with the ApplyRet fields other
+// Filecoin implementations are expected to reproduce.
+type MessageVector struct {
+	Msg      types.Message
+	ExitCode uint8
+	Return   []byte
+	GasUsed  int64
+}
+
+// Vector is one conformance test case: a pre-state, a sequence of messages
+// applied against it in order, and the state root the corpus author's VM
+// produced after applying them all.
+type Vector struct {
+	Comment       string
+	PreState      PreState
+	Messages      []MessageVector
+	PostStateRoot cid.Cid
+}
+
+// NamedVector pairs a Vector with the corpus-relative name subtests should
+// use, derived from its filename.
+type NamedVector struct {
+	Name   string
+	Vector *Vector
+}
+
+// LoadCorpus reads every *.json vector file in dir, returning them sorted by
+// filename so subtests run in a stable order.
+func LoadCorpus(dir string) ([]NamedVector, error) {
+	matches, err := filepath.Glob(filepath.Join(dir, "*.json"))
+	if err != nil {
+		return nil, xerrors.Errorf("globbing corpus dir %q: %w", dir, err)
+	}
+
+	var out []NamedVector
+	for _, m := range matches {
+		v, err := loadVector(m)
+		if err != nil {
+			return nil, xerrors.Errorf("loading vector %q: %w", m, err)
+		}
+		name := strings.TrimSuffix(filepath.Base(m), filepath.Ext(m))
+		out = append(out, NamedVector{Name: name, Vector: v})
+	}
+	return out, nil
+}
+
+func loadVector(path string) (*Vector, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var v Vector
+	if err := json.Unmarshal(b, &v); err != nil {
+		return nil, xerrors.Errorf("unmarshaling vector: %w", err)
+	}
+	return &v, nil
+}
+
+// WriteVector serializes v as indented JSON to path, overwriting any
+// existing file. Used by -conformance.generate to write the harness output
+// back into the vector file it was run from.
+func WriteVector(path string, v *Vector) error {
+	b, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return xerrors.Errorf("marshaling vector: %w", err)
+	}
+	return ioutil.WriteFile(path, b, 0644)
+}